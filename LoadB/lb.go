@@ -1,13 +1,28 @@
 package loadb
 
 import (
-	"log"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+
+	"Suboptimal/Firewall/events"
+	"Suboptimal/Firewall/metrics"
 )
 
+// ErrNoServerAvailable is returned by the server-selection methods when
+// every backend is currently failing its health check.
+var ErrNoServerAvailable = errors.New("loadb: no available backend servers")
+
 type Loadbalancer struct {
 	Port            string
 	Servers         []Server
@@ -15,31 +30,42 @@ type Loadbalancer struct {
 	SessionTable    map[string]Server
 	mu              sync.Mutex
 	Algorithm       string // "roundrobin" or "leastconn"
+	logger          *zap.Logger
+	events          *events.Bus
 }
 
-func NewLoadbalancer(p string, Servers []Server, algorithm string) *Loadbalancer {
+func NewLoadbalancer(p string, Servers []Server, algorithm string, logger *zap.Logger, bus *events.Bus) *Loadbalancer {
 	return &Loadbalancer{
 		Port:            p,
 		RoundRobinCount: 0,
 		Servers:         Servers,
 		SessionTable:    make(map[string]Server),
 		Algorithm:       algorithm,
+		logger:          logger,
+		events:          bus,
 	}
 }
 
-func (lb *Loadbalancer) GetNextAvailableServer() Server {
+// GetNextAvailableServer returns the next alive server in round-robin order,
+// or ErrNoServerAvailable if every server is currently failing its health
+// check.
+func (lb *Loadbalancer) GetNextAvailableServer() (Server, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
-	server := lb.Servers[lb.RoundRobinCount%len(lb.Servers)]
-	for !server.IsAlive() {
+	for i := 0; i < len(lb.Servers); i++ {
+		server := lb.Servers[lb.RoundRobinCount%len(lb.Servers)]
 		lb.RoundRobinCount++
-		server = lb.Servers[lb.RoundRobinCount%len(lb.Servers)]
+		if server.IsAlive() {
+			return server, nil
+		}
 	}
-	lb.RoundRobinCount++
-	return server
+	return nil, ErrNoServerAvailable
 }
 
-func (lb *Loadbalancer) GetLeastConnServer() Server {
+// GetLeastConnServer returns the alive server with the fewest active
+// connections, or ErrNoServerAvailable if every server is currently failing
+// its health check.
+func (lb *Loadbalancer) GetLeastConnServer() (Server, error) {
 	lb.mu.Lock()
 	defer lb.mu.Unlock()
 	var selected Server
@@ -51,42 +77,79 @@ func (lb *Loadbalancer) GetLeastConnServer() Server {
 			selected = server
 		}
 	}
-	return selected
+	if selected == nil {
+		return nil, ErrNoServerAvailable
+	}
+	return selected, nil
 }
 
 // Sticky Http ie: Session based Server allocation Works!
 func (lb *Loadbalancer) ServeProxy(wr http.ResponseWriter, r *http.Request) {
 	sessionID := r.Header.Get("Session-ID")
 	var targetServer Server
+	var err error
 
 	if sessionID != "" {
-		if lb.SessionTable[sessionID] != nil {
-			targetServer = lb.SessionTable[sessionID]
+		if cached := lb.SessionTable[sessionID]; cached != nil && cached.IsAlive() {
+			targetServer = cached
 		} else {
-			targetServer = lb.GetNextAvailableServer()
+			targetServer, err = lb.GetNextAvailableServer()
+			if err != nil {
+				lb.logger.Error("no backend available for session", zap.Error(err))
+				http.Error(wr, "Service Unavailable", http.StatusServiceUnavailable)
+				return
+			}
 			lb.SessionTable[sessionID] = targetServer
 		}
 	} else {
 		if lb.Algorithm == "lc" {
-			targetServer = lb.GetLeastConnServer()
-		} else if lb.Algorithm == "rr" {
-			targetServer = lb.GetNextAvailableServer()
+			targetServer, err = lb.GetLeastConnServer()
+		} else {
+			targetServer, err = lb.GetNextAvailableServer()
+		}
+		if err != nil {
+			lb.logger.Error("no backend available", zap.Error(err))
+			http.Error(wr, "Service Unavailable", http.StatusServiceUnavailable)
+			return
 		}
 	}
+
 	targetServer.IncActiveConn()
+	defer targetServer.DecActiveConn()
+
+	lb.logger.Info("forwarding request",
+		zap.String("address", targetServer.Address()),
+		zap.String("request_id", r.Header.Get("X-Request-ID")),
+	)
+	metrics.BackendRequestsTotal.WithLabelValues(targetServer.Address()).Inc()
+	start := time.Now()
+	if isWebSocketUpgrade(r) {
+		targetServer.ServeWS(wr, r)
+	} else {
+		targetServer.Serve(wr, r)
+	}
+	metrics.BackendLatencySeconds.WithLabelValues(targetServer.Address()).Observe(time.Since(start).Seconds())
 
-	log.Printf("forwarding requests to address %q\n", targetServer.Address())
-	targetServer.Serve(wr, r)
+	lb.events.Publish(events.Event{
+		Type:    events.TypeRequestServed,
+		Address: targetServer.Address(),
+	})
+}
 
-	// lb.mu.Lock()
-	// targetServer.DecActiveConn()
-	// lb.mu.Unlock()
+// isWebSocketUpgrade reports whether r is asking to upgrade the connection
+// to a WebSocket, which httputil.ReverseProxy's Director does not forward
+// correctly on its own.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
 }
 
 type Server interface {
 	Address() string
 	IsAlive() bool
 	Serve(rw http.ResponseWriter, r *http.Request)
+	// ServeWS hijacks the connection and proxies a WebSocket upgrade
+	// request to the backend, pumping frames in both directions.
+	ServeWS(w http.ResponseWriter, r *http.Request)
 	ActiveConn() int
 	IncActiveConn()
 	DecActiveConn()
@@ -97,9 +160,12 @@ type SimpleServer struct {
 	proxy      httputil.ReverseProxy
 	activeConn int
 	mu         sync.Mutex
+	logger     *zap.Logger
+	events     *events.Bus
+	alive      atomic.Bool
 }
 
-func NewServer(addr string) *SimpleServer {
+func NewServer(addr string, logger *zap.Logger, bus *events.Bus) *SimpleServer {
 	serverUrl, err := url.Parse(addr)
 	if err != nil {
 		panic(err)
@@ -114,10 +180,21 @@ func NewServer(addr string) *SimpleServer {
 		}
 		req.Host = serverUrl.Host
 	}
-	return &SimpleServer{
-		addr:  addr,
-		proxy: *proxy,
+	proxy.ErrorLog = zap.NewStdLog(logger.With(zap.String("address", addr)))
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		metrics.BackendErrorsTotal.WithLabelValues(addr).Inc()
+		logger.Error("proxy request failed", zap.String("address", addr), zap.Error(err))
+		w.WriteHeader(http.StatusBadGateway)
+	}
+	s := &SimpleServer{
+		addr:   addr,
+		proxy:  *proxy,
+		logger: logger,
+		events: bus,
 	}
+	s.alive.Store(true) // assumed healthy until SetHealthCheck says otherwise
+	metrics.BackendAlive.WithLabelValues(addr).Set(1)
+	return s
 }
 
 func (s *SimpleServer) Address() string {
@@ -125,13 +202,145 @@ func (s *SimpleServer) Address() string {
 }
 
 func (s *SimpleServer) IsAlive() bool {
-	return true
+	return s.alive.Load()
+}
+
+// SetHealthCheck starts a background goroutine that issues a GET request
+// against path every interval (capped at timeout) and flips s's alive flag
+// based on whether the probe returned a 200 OK.
+func (s *SimpleServer) SetHealthCheck(path string, interval, timeout time.Duration) {
+	client := &http.Client{Timeout: timeout}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.probe(client, path)
+		}
+	}()
+}
+
+func (s *SimpleServer) probe(client *http.Client, path string) {
+	resp, err := client.Get(strings.TrimRight(s.addr, "/") + path)
+	if err != nil {
+		s.setAlive(false)
+		s.logger.Warn("health check failed", zap.String("address", s.addr), zap.Error(err))
+		return
+	}
+	defer resp.Body.Close()
+
+	s.setAlive(resp.StatusCode == http.StatusOK)
+	if resp.StatusCode != http.StatusOK {
+		s.logger.Warn("health check unhealthy",
+			zap.String("address", s.addr),
+			zap.Int("status", resp.StatusCode),
+		)
+	}
+}
+
+// setAlive updates the health flag and, on an actual change, publishes a
+// health_flip event so operators watching the admin WebSocket see it.
+func (s *SimpleServer) setAlive(alive bool) {
+	if alive {
+		metrics.BackendAlive.WithLabelValues(s.addr).Set(1)
+	} else {
+		metrics.BackendAlive.WithLabelValues(s.addr).Set(0)
+	}
+	if s.alive.Swap(alive) == alive {
+		return
+	}
+	s.events.Publish(events.Event{
+		Type:    events.TypeHealthFlip,
+		Address: s.addr,
+		Alive:   &alive,
+	})
 }
 
 func (s *SimpleServer) Serve(w http.ResponseWriter, r *http.Request) {
 	s.proxy.ServeHTTP(w, r)
 }
 
+// websocketDialTimeout bounds how long ServeWS waits to establish the
+// upstream TCP (or TLS) connection before giving up.
+const websocketDialTimeout = 10 * time.Second
+
+// ServeWS hijacks the client connection, dials the upstream backend, and
+// pumps the WebSocket handshake plus all subsequent frames through
+// unmodified in both directions. httputil.ReverseProxy's Director strips
+// and reshapes headers in ways that break the Upgrade handshake, so
+// WebSocket traffic is proxied at the raw connection level instead.
+func (s *SimpleServer) ServeWS(w http.ResponseWriter, r *http.Request) {
+	upstream, err := dialUpstream(s.addr, websocketDialTimeout)
+	if err != nil {
+		metrics.BackendErrorsTotal.WithLabelValues(s.addr).Inc()
+		s.logger.Error("websocket dial to upstream failed", zap.String("address", s.addr), zap.Error(err))
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "websocket upgrade not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		s.logger.Error("failed to hijack client connection", zap.Error(err))
+		return
+	}
+
+	if err := r.Write(upstream); err != nil {
+		s.logger.Error("failed to forward websocket handshake upstream", zap.Error(err))
+		client.Close()
+		upstream.Close()
+		return
+	}
+
+	s.logger.Info("websocket connection established", zap.String("address", s.addr))
+	pumpWebSocket(client, upstream)
+	s.logger.Info("websocket connection closed", zap.String("address", s.addr))
+}
+
+// dialUpstream opens a plain TCP or TLS connection to target depending on
+// its scheme, matching how http.Transport would dial it.
+func dialUpstream(target string, timeout time.Duration) (net.Conn, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, err
+	}
+	host := u.Host
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		if u.Scheme == "https" {
+			host = net.JoinHostPort(host, "443")
+		} else {
+			host = net.JoinHostPort(host, "80")
+		}
+	}
+	if u.Scheme == "https" {
+		return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", host, &tls.Config{ServerName: u.Hostname()})
+	}
+	return net.DialTimeout("tcp", host, timeout)
+}
+
+// pumpWebSocket relays bytes between client and upstream until either side
+// closes or errors, then closes both ends.
+func pumpWebSocket(client, upstream net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		io.Copy(upstream, client)
+		upstream.Close()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(client, upstream)
+		client.Close()
+	}()
+	wg.Wait()
+}
+
 func (s *SimpleServer) ActiveConn() int {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -142,10 +351,12 @@ func (s *SimpleServer) IncActiveConn() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.activeConn++
+	metrics.BackendActiveConnections.WithLabelValues(s.addr).Set(float64(s.activeConn))
 }
 
 func (s *SimpleServer) DecActiveConn() {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 	s.activeConn--
+	metrics.BackendActiveConnections.WithLabelValues(s.addr).Set(float64(s.activeConn))
 }
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/gorilla/websocket"
+	"go.uber.org/zap"
+
+	"Suboptimal/Firewall/events"
+)
+
+// adminWSUpgrader accepts WebSocket upgrades from the admin event stream.
+// It leaves CheckOrigin unset so gorilla/websocket falls back to its
+// default same-origin check, rejecting cross-site upgrade attempts from a
+// browser; the endpoint is also served only on the internal metrics
+// listener, not the public one, as the primary access boundary.
+var adminWSUpgrader = websocket.Upgrader{}
+
+// subscribeMsg is sent by a client to restrict which event types it wants to
+// receive. An empty or absent Types list means "all events".
+type subscribeMsg struct {
+	Types []string `json:"types"`
+}
+
+// adminEventsHandler streams the firewall's live activity feed over a
+// WebSocket: every rate-limit decision, ban/unban and backend health flip
+// published to bus is fanned out to connected operators as JSON.
+func adminEventsHandler(bus *events.Bus, logger *zap.Logger) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		conn, err := adminWSUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			logger.Error("admin websocket upgrade failed", zap.Error(err))
+			return
+		}
+		defer conn.Close()
+
+		ch := bus.Subscribe()
+		defer bus.Unsubscribe(ch)
+
+		filter := make(map[string]struct{})
+		var filterMu sync.Mutex
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for {
+				var msg subscribeMsg
+				if err := conn.ReadJSON(&msg); err != nil {
+					return
+				}
+				set := make(map[string]struct{}, len(msg.Types))
+				for _, t := range msg.Types {
+					set[t] = struct{}{}
+				}
+				filterMu.Lock()
+				filter = set
+				filterMu.Unlock()
+			}
+		}()
+
+		for {
+			select {
+			case <-done:
+				return
+			case ev, ok := <-ch:
+				if !ok {
+					return
+				}
+				filterMu.Lock()
+				_, wanted := filter[ev.Type]
+				passesFilter := len(filter) == 0 || wanted
+				filterMu.Unlock()
+				if !passesFilter {
+					continue
+				}
+				if err := conn.WriteJSON(ev); err != nil {
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"go.etcd.io/bbolt"
+	"go.uber.org/zap"
+)
+
+// watchBanStore consumes store's BanEvent stream and pushes each change onto
+// blacklistCh/unblockCh, the same channels PkfilterInit reads to apply
+// kernel-level rules. Without this, a ban or unban made on another firewall
+// node sharing store would only be noticed lazily, the next time that IP
+// happened to make an HTTP request here. It exits once ctx is cancelled.
+func watchBanStore(ctx context.Context, store BanStore, blacklistCh, unblockCh chan string, logger *zap.Logger) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case ev, ok := <-store.Subscribe():
+			if !ok {
+				return
+			}
+			ch := unblockCh
+			if ev.Banned {
+				ch = blacklistCh
+			}
+			select {
+			case ch <- ev.IP:
+				logger.Info("applied ban store change", zap.String("ip", ev.IP), zap.Bool("banned", ev.Banned))
+			case <-ctx.Done():
+				return
+			}
+		}
+	}
+}
+
+// BanEvent describes a change in a BanStore's ban state. Subscribe()
+// delivers these for Ban/Unban calls, including ones made by other firewall
+// nodes sharing the same store, so a fleet of instances converges on a
+// coherent ban view. Delivery is best-effort: the bolt store drops an event
+// when its buffer is full, leaving Bans() as the source of truth.
+type BanEvent struct {
+	IP        string
+	Banned    bool // false means the ban was lifted
+	ExpiresAt time.Time
+}
+
+// BanStore persists IP bans and fans out changes to every interested
+// firewall instance. A ttl of zero means the ban never expires on its own
+// and must be lifted with Unban.
+type BanStore interface {
+	Ban(ip string, ttl time.Duration) error
+	Unban(ip string) error
+	IsBanned(ip string) (bool, error)
+	// Bans returns every currently active ban, keyed by IP. It is used on
+	// startup to replay state so PkfilterInit can re-apply existing kernel
+	// rules.
+	Bans() (map[string]time.Time, error)
+	Subscribe() <-chan BanEvent
+	Close() error
+}
+
+// BanStoreConfig selects and configures a BanStore backend.
+type BanStoreConfig struct {
+	Backend   string `json:"backend"` // "bolt" or "redis"
+	BoltPath  string `json:"bolt_path"`
+	RedisAddr string `json:"redis_addr"`
+}
+
+const banStoreConfigPath = "banstore_config.json"
+
+func defaultBanStoreConfig() BanStoreConfig {
+	return BanStoreConfig{Backend: "bolt", BoltPath: "bans.db"}
+}
+
+// loadBanStoreConfig reads a BanStoreConfig from path. A missing file is not
+// an error: callers fall back to defaultBanStoreConfig, which needs no
+// external service to run.
+func loadBanStoreConfig(path string, logger *zap.Logger) (BanStoreConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("ban store config file not found, using defaults", zap.String("path", path))
+			return defaultBanStoreConfig(), nil
+		}
+		return BanStoreConfig{}, err
+	}
+
+	var cfg BanStoreConfig
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		return BanStoreConfig{}, fmt.Errorf("parsing ban store config file %q: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// newBanStore builds the BanStore selected by cfg.Backend. "bolt" gives
+// single-node persistence across restarts; "redis" fans bans out to every
+// firewall node watching the same Redis instance.
+func newBanStore(cfg BanStoreConfig) (BanStore, error) {
+	switch cfg.Backend {
+	case "", "bolt":
+		path := cfg.BoltPath
+		if path == "" {
+			path = defaultBanStoreConfig().BoltPath
+		}
+		return newBoltBanStore(path)
+	case "redis":
+		return newRedisBanStore(cfg.RedisAddr)
+	default:
+		return nil, fmt.Errorf("unknown ban store backend %q", cfg.Backend)
+	}
+}
+
+// boltBanStore persists bans to a local BoltDB file so a single firewall
+// instance keeps its ban list across restarts.
+type boltBanStore struct {
+	db      *bbolt.DB
+	eventCh chan BanEvent
+}
+
+var banBucket = []byte("bans")
+
+func newBoltBanStore(path string) (*boltBanStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 2 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("opening bolt ban store %q: %w", path, err)
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(banBucket)
+		return err
+	}); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("initializing bolt ban store: %w", err)
+	}
+	return &boltBanStore{db: db, eventCh: make(chan BanEvent, 16)}, nil
+}
+
+// encodeExpiry packs expiresAt as Unix nanoseconds, using 0 as a sentinel
+// for "never expires" rather than relying on the zero time.Time's UnixNano,
+// which overflows int64 and doesn't round-trip through time.Unix.
+func encodeExpiry(expiresAt time.Time) int64 {
+	if expiresAt.IsZero() {
+		return 0
+	}
+	return expiresAt.UnixNano()
+}
+
+// decodeExpiry reverses encodeExpiry, returning the zero time.Time for the
+// "never expires" sentinel.
+func decodeExpiry(v int64) time.Time {
+	if v == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, v)
+}
+
+func (s *boltBanStore) Ban(ip string, ttl time.Duration) error {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	err := s.db.Update(func(tx *bbolt.Tx) error {
+		buf := make([]byte, 8)
+		binary.BigEndian.PutUint64(buf, uint64(encodeExpiry(expiresAt)))
+		return tx.Bucket(banBucket).Put([]byte(ip), buf)
+	})
+	if err != nil {
+		return err
+	}
+	s.publish(BanEvent{IP: ip, Banned: true, ExpiresAt: expiresAt})
+	return nil
+}
+
+func (s *boltBanStore) Unban(ip string) error {
+	if err := s.db.Update(func(tx *bbolt.Tx) error {
+		return tx.Bucket(banBucket).Delete([]byte(ip))
+	}); err != nil {
+		return err
+	}
+	s.publish(BanEvent{IP: ip, Banned: false})
+	return nil
+}
+
+func (s *boltBanStore) IsBanned(ip string) (bool, error) {
+	var banned bool
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		v := tx.Bucket(banBucket).Get([]byte(ip))
+		if v == nil {
+			return nil
+		}
+		expiresAt := decodeExpiry(int64(binary.BigEndian.Uint64(v)))
+		banned = expiresAt.IsZero() || time.Now().Before(expiresAt)
+		return nil
+	})
+	return banned, err
+}
+
+func (s *boltBanStore) Bans() (map[string]time.Time, error) {
+	out := make(map[string]time.Time)
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(banBucket).ForEach(func(k, v []byte) error {
+			expiresAt := decodeExpiry(int64(binary.BigEndian.Uint64(v)))
+			if expiresAt.IsZero() || time.Now().Before(expiresAt) {
+				out[string(k)] = expiresAt
+			}
+			return nil
+		})
+	})
+	return out, err
+}
+
+func (s *boltBanStore) Subscribe() <-chan BanEvent {
+	return s.eventCh
+}
+
+func (s *boltBanStore) Close() error {
+	close(s.eventCh)
+	return s.db.Close()
+}
+
+func (s *boltBanStore) publish(ev BanEvent) {
+	select {
+	case s.eventCh <- ev:
+	default:
+		// Drop rather than block the caller; Bans() remains the source of
+		// truth for anyone who missed the event.
+	}
+}
+
+// redisBanStore persists bans as keys with a native Redis TTL and fans out
+// Ban/Unban events over a pub/sub channel, so every firewall node watching
+// the same Redis instance converges on the same ban view.
+type redisBanStore struct {
+	client    *redis.Client
+	ctx       context.Context
+	cancel    context.CancelFunc
+	eventCh   chan BanEvent
+	keyPrefix string
+}
+
+const redisBanChannel = "firewall:bans"
+
+func newRedisBanStore(addr string) (*redisBanStore, error) {
+	client := redis.NewClient(&redis.Options{Addr: addr})
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := client.Ping(ctx).Err(); err != nil {
+		cancel()
+		return nil, fmt.Errorf("connecting to redis ban store at %q: %w", addr, err)
+	}
+
+	s := &redisBanStore{
+		client:    client,
+		ctx:       ctx,
+		cancel:    cancel,
+		eventCh:   make(chan BanEvent, 16),
+		keyPrefix: "firewall:ban:",
+	}
+	go s.listen()
+	return s, nil
+}
+
+func (s *redisBanStore) Ban(ip string, ttl time.Duration) error {
+	expiresAt := time.Time{}
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	if err := s.client.Set(s.ctx, s.keyPrefix+ip, expiresAt.Format(time.RFC3339Nano), ttl).Err(); err != nil {
+		return err
+	}
+	return s.publish(BanEvent{IP: ip, Banned: true, ExpiresAt: expiresAt})
+}
+
+func (s *redisBanStore) Unban(ip string) error {
+	if err := s.client.Del(s.ctx, s.keyPrefix+ip).Err(); err != nil {
+		return err
+	}
+	return s.publish(BanEvent{IP: ip, Banned: false})
+}
+
+func (s *redisBanStore) IsBanned(ip string) (bool, error) {
+	n, err := s.client.Exists(s.ctx, s.keyPrefix+ip).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (s *redisBanStore) Bans() (map[string]time.Time, error) {
+	out := make(map[string]time.Time)
+	iter := s.client.Scan(s.ctx, 0, s.keyPrefix+"*", 0).Iterator()
+	for iter.Next(s.ctx) {
+		key := iter.Val()
+		val, err := s.client.Get(s.ctx, key).Result()
+		if err != nil {
+			continue
+		}
+		expiresAt, _ := time.Parse(time.RFC3339Nano, val)
+		out[key[len(s.keyPrefix):]] = expiresAt
+	}
+	return out, iter.Err()
+}
+
+func (s *redisBanStore) Subscribe() <-chan BanEvent {
+	return s.eventCh
+}
+
+func (s *redisBanStore) Close() error {
+	s.cancel()
+	return s.client.Close()
+}
+
+func (s *redisBanStore) publish(ev BanEvent) error {
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	return s.client.Publish(s.ctx, redisBanChannel, data).Err()
+}
+
+func (s *redisBanStore) listen() {
+	sub := s.client.Subscribe(s.ctx, redisBanChannel)
+	defer sub.Close()
+	ch := sub.Channel()
+	defer close(s.eventCh)
+	for {
+		select {
+		case <-s.ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			var ev BanEvent
+			if err := json.Unmarshal([]byte(msg.Payload), &ev); err != nil {
+				continue
+			}
+			select {
+			case s.eventCh <- ev:
+			case <-s.ctx.Done():
+				return
+			}
+		}
+	}
+}
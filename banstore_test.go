@@ -0,0 +1,75 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestBoltBanStorePermanentBan guards against a bug where a ttl=0 ("never
+// expires") ban was encoded using the zero time.Time's UnixNano, which
+// overflows int64 and doesn't round-trip through time.Unix, silently
+// un-banning every permanently blacklisted IP as soon as the read hit disk.
+func TestBoltBanStorePermanentBan(t *testing.T) {
+	store, err := newBoltBanStore(filepath.Join(t.TempDir(), "bans.db"))
+	if err != nil {
+		t.Fatalf("newBoltBanStore: %v", err)
+	}
+	defer store.Close()
+
+	const ip = "1.2.3.4"
+	if err := store.Ban(ip, 0); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+
+	banned, err := store.IsBanned(ip)
+	if err != nil {
+		t.Fatalf("IsBanned: %v", err)
+	}
+	if !banned {
+		t.Fatalf("IsBanned(%q) = false after a permanent ban, want true", ip)
+	}
+
+	bans, err := store.Bans()
+	if err != nil {
+		t.Fatalf("Bans: %v", err)
+	}
+	expiresAt, ok := bans[ip]
+	if !ok {
+		t.Fatalf("Bans() missing %q", ip)
+	}
+	if !expiresAt.IsZero() {
+		t.Fatalf("Bans()[%q] = %v, want zero time for a permanent ban", ip, expiresAt)
+	}
+}
+
+// TestBoltBanStoreTemporaryBan checks that a ttl>0 ban still expires and
+// round-trips its expiry time correctly alongside the ttl=0 sentinel fix.
+func TestBoltBanStoreTemporaryBan(t *testing.T) {
+	store, err := newBoltBanStore(filepath.Join(t.TempDir(), "bans.db"))
+	if err != nil {
+		t.Fatalf("newBoltBanStore: %v", err)
+	}
+	defer store.Close()
+
+	const ip = "5.6.7.8"
+	if err := store.Ban(ip, time.Hour); err != nil {
+		t.Fatalf("Ban: %v", err)
+	}
+
+	banned, err := store.IsBanned(ip)
+	if err != nil {
+		t.Fatalf("IsBanned: %v", err)
+	}
+	if !banned {
+		t.Fatalf("IsBanned(%q) = false right after a 1h ban, want true", ip)
+	}
+
+	bans, err := store.Bans()
+	if err != nil {
+		t.Fatalf("Bans: %v", err)
+	}
+	if expiresAt, ok := bans[ip]; !ok || expiresAt.IsZero() {
+		t.Fatalf("Bans()[%q] = %v, want a non-zero future expiry", ip, expiresAt)
+	}
+}
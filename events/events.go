@@ -0,0 +1,73 @@
+// Package events is the firewall's activity bus: the rate limiter, load
+// balancer and backend health checkers publish to it, and the admin
+// WebSocket endpoint fans those events out to operators tailing firewall
+// activity in real time.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Event types published onto a Bus.
+const (
+	TypeIPSeen        = "ip_seen"
+	TypeBrownlisted   = "brownlisted"
+	TypeBlacklisted   = "blacklisted"
+	TypeUnblocked     = "unblocked"
+	TypeHealthFlip    = "health_flip"
+	TypeRequestServed = "request_served"
+)
+
+// Event is a single firewall activity record.
+type Event struct {
+	Type      string    `json:"type"`
+	IP        string    `json:"ip,omitempty"`
+	Address   string    `json:"address,omitempty"`
+	Alive     *bool     `json:"alive,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Bus fans Events out to every current subscriber. Publish is best-effort:
+// a slow or gone subscriber never blocks the caller.
+type Bus struct {
+	mu   sync.Mutex
+	subs map[chan Event]struct{}
+}
+
+// NewBus returns an empty, ready-to-use Bus.
+func NewBus() *Bus {
+	return &Bus{subs: make(map[chan Event]struct{})}
+}
+
+// Publish stamps ev with the current time and delivers it to every current
+// subscriber, dropping it for subscribers whose buffer is full.
+func (b *Bus) Publish(ev Event) {
+	ev.Timestamp = time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- ev:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel that receives every Event published from now
+// on. Callers must pass the channel to Unsubscribe when done.
+func (b *Bus) Subscribe() chan Event {
+	ch := make(chan Event, 32)
+	b.mu.Lock()
+	b.subs[ch] = struct{}{}
+	b.mu.Unlock()
+	return ch
+}
+
+// Unsubscribe stops ch from receiving further events and closes it.
+func (b *Bus) Unsubscribe(ch chan Event) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+	close(ch)
+}
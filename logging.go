@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// LogConfig controls how the shared zap logger built in main is encoded and
+// filtered.
+type LogConfig struct {
+	Encoding string // "json" or "console"
+	Level    string // debug, info, warn, error
+}
+
+// newLogger builds the single *zap.Logger shared by the rate limiter, load
+// balancer and backend servers. Logs are written to Firewall.log, same as
+// the file the old standard-library logger wrote to.
+func newLogger(cfg LogConfig) (*zap.Logger, error) {
+	var level zapcore.Level
+	if err := level.Set(cfg.Level); err != nil {
+		return nil, fmt.Errorf("invalid log level %q: %w", cfg.Level, err)
+	}
+
+	encoding := cfg.Encoding
+	if encoding != "json" && encoding != "console" {
+		return nil, fmt.Errorf("invalid log encoding %q: must be \"json\" or \"console\"", encoding)
+	}
+
+	zapCfg := zap.NewProductionConfig()
+	zapCfg.Encoding = encoding
+	zapCfg.Level = zap.NewAtomicLevelAt(level)
+	zapCfg.OutputPaths = []string{"Firewall.log"}
+	zapCfg.ErrorOutputPaths = []string{"Firewall.log"}
+	// Zap's default sampler keys on (level, message), not fields, so a burst
+	// of distinct offending IPs sharing the same "ip blacklisted"/"ip
+	// brown-listed" message would otherwise get silently dropped after the
+	// first 100/sec — exactly the audit trail this logger exists to keep.
+	zapCfg.Sampling = nil
+	if encoding == "console" {
+		zapCfg.EncoderConfig = zap.NewDevelopmentEncoderConfig()
+	}
+
+	return zapCfg.Build()
+}
+
+// newRequestID returns a short random hex string used to correlate every
+// log line emitted while handling a single request.
+func newRequestID() string {
+	buf := make([]byte, 8)
+	if _, err := rand.Read(buf); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(buf)
+}
@@ -2,9 +2,11 @@ package main
 
 import (
 	loadb "Suboptimal/Firewall/LoadB"
+	"Suboptimal/Firewall/events"
 	"context"
+	"flag"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/signal"
@@ -12,6 +14,8 @@ import (
 	"sync"
 	"syscall"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 var (
@@ -20,134 +24,77 @@ var (
 	brownListedDuration = 25 * time.Second
 )
 
-type rateLimiter struct {
-	requests    map[string][]time.Time
-	blackList   map[string]bool
-	brownList   map[string]time.Time
-	mu          sync.Mutex
-	blacklistCh chan string
-	unblockCh   chan string
-}
-
-func newRateLimiter(blacklistCh chan string, unblockCh chan string) *rateLimiter {
-	rl := &rateLimiter{
-		requests:    make(map[string][]time.Time),
-		blackList:   make(map[string]bool),
-		brownList:   make(map[string]time.Time),
-		blacklistCh: blacklistCh,
-		unblockCh:   unblockCh,
-	}
-	go rl.cleanUp()
-	return rl
-}
-
-func (rl *rateLimiter) sessionCheck(ip string) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	if endTime, found := rl.brownList[ip]; found {
-		if time.Now().Before(endTime) {
-			return false
-		} else {
-			delete(rl.brownList, ip) // Remove from brown-list after duration expires
-			// No point in sending channel here , this needs an invocation which will not be bypassed by the firewall in the first place
-		}
-	}
-
-	now := time.Now()
-	rl.requests[ip] = append(rl.requests[ip], now)
-
-	cutoff := now.Add(-trackingDuration)
-	filteredRequests := []time.Time{}
+// policyConfigPath is where main looks for the per-class rate limit
+// policies; a missing file falls back to defaultPolicyConfig.
+const policyConfigPath = "ratelimit_policies.json"
 
-	for _, t := range rl.requests[ip] {
-		if t.After(cutoff) {
-			filteredRequests = append(filteredRequests, t)
+// runServer serves srv on ln until it receives a signal on sigCh or the
+// listener itself fails, then gives in-flight requests up to drainTimeout
+// to finish via srv.Shutdown before returning.
+func runServer(srv *http.Server, ln net.Listener, sigCh <-chan os.Signal, drainTimeout time.Duration, logger *zap.Logger) error {
+	serverErrors := make(chan error, 1)
+	go func() {
+		logger.Info("serving requests", zap.String("addr", ln.Addr().String()))
+		if err := srv.Serve(ln); err != nil && err != http.ErrServerClosed {
+			serverErrors <- err
+			return
 		}
-	}
-	rl.requests[ip] = filteredRequests
-
-	if len(rl.requests[ip]) > rateLimit {
-		rl.brownList[ip] = now.Add(brownListedDuration)
-		log.Printf("IP %s has been brown-listed 🚫", ip)
-		fmt.Printf("IP %s has been brown-listed 🚫", ip)
-		rl.blacklistCh <- ip
-		go startTimer(ip, rl.unblockCh, brownListedDuration)
-		return false
-	}
-
-	return true
-}
-
-func startTimer(ip string, unblockCh chan string, duration time.Duration) {
-	time.Sleep(duration)
-	log.Printf("Access to IP %s has been Granted ✅", ip)
-	unblockCh <- ip
-}
-
-func (rl *rateLimiter) limitCheck(ip string) bool {
-	rl.mu.Lock()
-	defer rl.mu.Unlock()
-
-	if rl.blackList[ip] {
-		return false
-	}
-
-	now := time.Now()
-	rl.requests[ip] = append(rl.requests[ip], now)
-
-	cutoff := now.Add(-trackingDuration)
-	filteredRequests := []time.Time{}
+		serverErrors <- nil
+	}()
 
-	for _, t := range rl.requests[ip] {
-		if t.After(cutoff) {
-			filteredRequests = append(filteredRequests, t)
-		}
-	}
-	rl.requests[ip] = filteredRequests
-
-	if len(rl.requests[ip]) > rateLimit {
-		rl.blackList[ip] = true
-		log.Printf("IP %s has been blacklisted ❗❌❗", ip)
-		fmt.Printf("IP %s has been blacklisted ❗❌❗", ip)
-		rl.blacklistCh <- ip
-		return false
+	var runErr error
+	select {
+	case <-sigCh:
+		logger.Info("received shutdown signal, draining in-flight requests")
+	case err := <-serverErrors:
+		runErr = err
 	}
 
-	return true
-}
-
-func (rl *rateLimiter) cleanUp() {
-	for {
-		time.Sleep(trackingDuration)
-		rl.mu.Lock()
-		for ip, times := range rl.requests {
-			cutoff := time.Now().Add(-trackingDuration)
-			filteredRequests := []time.Time{}
-
-			for _, t := range times {
-				if t.After(cutoff) {
-					filteredRequests = append(filteredRequests, t)
-				}
-			}
-			rl.requests[ip] = filteredRequests
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		logger.Error("error during graceful shutdown", zap.Error(err))
+		if runErr == nil {
+			runErr = err
 		}
-		rl.mu.Unlock()
 	}
+	return runErr
 }
 
 func main() {
-	// Initialize logging to file
-	logFile, err := os.OpenFile("Firewall.log", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0666)
+	logEncoding := flag.String("log-encoding", "json", "log encoding: json or console")
+	logLevel := flag.String("log-level", "info", "log level: debug, info, warn, error")
+	drainTimeout := flag.Duration("drain-timeout", 15*time.Second, "graceful shutdown drain timeout")
+	metricsAddr := flag.String("metrics-addr", "127.0.0.1:9090", "address to serve /metrics and /debug/pprof on")
+	healthCheckPath := flag.String("health-check-path", "/", "path probed on each backend for health checks")
+	healthCheckInterval := flag.Duration("health-check-interval", 10*time.Second, "interval between backend health checks")
+	healthCheckTimeout := flag.Duration("health-check-timeout", 2*time.Second, "timeout for a single backend health check request")
+	flag.Parse()
+
+	logger, err := newLogger(LogConfig{Encoding: *logEncoding, Level: *logLevel})
 	if err != nil {
-		fmt.Printf("Error opening log file: %v\n", err)
+		fmt.Printf("Error initializing logger: %v\n", err)
 		return
 	}
-	defer logFile.Close()
-	log.SetOutput(logFile)
+	defer logger.Sync()
 
-	// Log the start of the application
-	log.Println("\nFirewall Activated 🛡")
+	logger.Info("firewall activated")
+
+	bus := events.NewBus()
+
+	metricsSrv := newMetricsServer(*metricsAddr, bus, logger)
+	go func() {
+		if err := metricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Error("metrics server error", zap.Error(err))
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), *drainTimeout)
+		defer cancel()
+		if err := metricsSrv.Shutdown(shutdownCtx); err != nil {
+			logger.Error("error shutting down metrics server", zap.Error(err))
+		}
+	}()
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -162,62 +109,116 @@ func main() {
 		PkfilterInit(ctx, blacklistCh, unblockCh)
 	}()
 
-	rl := newRateLimiter(blacklistCh, unblockCh)
-	servers := []loadb.Server{
-		loadb.NewServer("https://www.youtube.com/"),
-		loadb.NewServer("https://wasmcloud.com/"),
-		loadb.NewServer("https://x.com/"),
+	policies, err := loadPolicyConfig(policyConfigPath, logger)
+	if err != nil {
+		logger.Error("failed to load rate limit policies", zap.Error(err))
+		return
+	}
+
+	banStoreCfg, err := loadBanStoreConfig(banStoreConfigPath, logger)
+	if err != nil {
+		logger.Error("failed to load ban store config", zap.Error(err))
+		return
+	}
+	banStore, err := newBanStore(banStoreCfg)
+	if err != nil {
+		logger.Error("failed to initialize ban store", zap.String("backend", banStoreCfg.Backend), zap.Error(err))
+		return
+	}
+	defer banStore.Close()
+
+	existingBans, err := banStore.Bans()
+	if err != nil {
+		logger.Error("failed to load existing bans from store", zap.Error(err))
+	} else {
+		for ip := range existingBans {
+			select {
+			case blacklistCh <- ip:
+			case <-ctx.Done():
+			}
+		}
+		logger.Info("replayed bans from store", zap.Int("count", len(existingBans)))
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		watchBanStore(ctx, banStore, blacklistCh, unblockCh, logger)
+	}()
+
+	rl := newRateLimiter(ctx, blacklistCh, unblockCh, policies, banStore, bus, logger)
+	backends := []*loadb.SimpleServer{
+		loadb.NewServer("https://www.youtube.com/", logger, bus),
+		loadb.NewServer("https://wasmcloud.com/", logger, bus),
+		loadb.NewServer("https://x.com/", logger, bus),
 	}
-	lb := loadb.NewLoadbalancer("8080", servers, "lc")
+	servers := make([]loadb.Server, len(backends))
+	for i, backend := range backends {
+		backend.SetHealthCheck(*healthCheckPath, *healthCheckInterval, *healthCheckTimeout)
+		servers[i] = backend
+	}
+	lb := loadb.NewLoadbalancer("8080", servers, "lc", logger, bus)
 
 	handleRedirect := func(w http.ResponseWriter, r *http.Request) {
+		reqID := newRequestID()
+		r.Header.Set("X-Request-ID", reqID)
+		w.Header().Set("X-Request-ID", reqID)
+		reqLogger := logger.With(zap.String("request_id", reqID))
+
 		clientIP := strings.Split(r.RemoteAddr, ":")[0]
+		class := policies.classify(r)
+		w.Header().Set("X-RateLimit-Class", class)
+
 		if sessionID := r.Header.Get("Session-ID"); sessionID != "" {
-			ok := rl.sessionCheck(clientIP)
+			ok, retryAfter := rl.sessionCheck(clientIP, class, reqLogger)
 			if !ok {
+				w.Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter.Seconds()))
 				http.Error(w, "Session Rate Limit exceeded", http.StatusTooManyRequests)
-				log.Printf("Session limit exceeded for IP: %s", clientIP)
+				reqLogger.Warn("session limit exceeded", zap.String("ip", clientIP))
 				return
 			}
 		} else {
-			if !rl.limitCheck(clientIP) {
+			ok, retryAfter := rl.limitCheck(clientIP, class, reqLogger)
+			if !ok {
+				w.Header().Set("Retry-After", fmt.Sprintf("%.0f", retryAfter.Seconds()))
 				http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-				log.Printf("Rate limit exceeded for IP: %s", clientIP)
+				reqLogger.Warn("rate limit exceeded", zap.String("ip", clientIP))
 				return
 			}
 		}
 
-		log.Printf("Redirecting request from IP: %s", clientIP)
+		reqLogger.Info("redirecting request", zap.String("ip", clientIP))
 		lb.ServeProxy(w, r)
 	}
 
-	http.HandleFunc("/", handleRedirect)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleRedirect)
+	srv := &http.Server{Handler: mux}
+
+	ln, err := net.Listen("tcp", ":"+lb.Port)
+	if err != nil {
+		logger.Error("failed to listen", zap.String("port", lb.Port), zap.Error(err))
+		return
+	}
 
 	// Set up signal handling
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
 
-	// Start the HTTP server in a goroutine
-	serverErrors := make(chan error, 1)
-	go func() {
-		log.Printf("Serving requests at localhost:%s", lb.Port)
-		fmt.Printf("Serving requests at localhost:%s\n", lb.Port)
-		serverErrors <- http.ListenAndServe(":"+lb.Port, nil)
-	}()
-
-	// Wait for shutdown signal or server error
-	select {
-	case <-sigCh:
-		fmt.Println("\nReceived shutdown signal. Stopping...")
-	case err := <-serverErrors:
-		fmt.Printf("Server error: %v\n", err)
+	if err := runServer(srv, ln, sigCh, *drainTimeout, logger); err != nil {
+		logger.Error("server error", zap.Error(err))
 	}
 
-	// Cancel the context to signal all goroutines to stop
+	// Only now that in-flight requests have drained do we stop the rate
+	// limiter's background sweeper, the pending unblock timers, the ban
+	// store watcher, and PkfilterInit. Only once all four have actually
+	// exited is it safe to close the channels they send/receive on.
 	cancel()
-
-	// Wait for PkfilterInit to finish
+	rl.Wait()
 	wg.Wait()
 
-	fmt.Println("All operations stopped. Goodbye! 😭👋")
+	close(blacklistCh)
+	close(unblockCh)
+
+	logger.Info("all operations stopped")
 }
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// TestRunServerDrainsInFlightRequest fires a slow request against a server
+// managed by runServer, sends a shutdown signal while that request is still
+// in flight, and asserts the response still completes with 200 instead of
+// being cut off.
+func TestRunServerDrainsInFlightRequest(t *testing.T) {
+	logger := zap.NewNop()
+
+	reachedHandler := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		close(reachedHandler)
+		time.Sleep(300 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	})
+	srv := &http.Server{Handler: mux}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+
+	sigCh := make(chan os.Signal, 1)
+	runDone := make(chan error, 1)
+	go func() {
+		runDone <- runServer(srv, ln, sigCh, 2*time.Second, logger)
+	}()
+
+	type result struct {
+		status int
+		err    error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/slow")
+		if err != nil {
+			resultCh <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		resultCh <- result{status: resp.StatusCode}
+	}()
+
+	select {
+	case <-reachedHandler:
+	case <-time.After(2 * time.Second):
+		t.Fatal("request never reached the handler")
+	}
+	sigCh <- syscall.SIGTERM
+
+	select {
+	case res := <-resultCh:
+		if res.err != nil {
+			t.Fatalf("in-flight request failed: %v", res.err)
+		}
+		if res.status != http.StatusOK {
+			t.Fatalf("expected status 200, got %d", res.status)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("timed out waiting for in-flight request to complete")
+	}
+
+	if err := <-runDone; err != nil {
+		t.Fatalf("runServer returned error: %v", err)
+	}
+}
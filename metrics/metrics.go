@@ -0,0 +1,67 @@
+// Package metrics holds the Prometheus collectors shared by the rate
+// limiter and the load balancer, so both can be instrumented without
+// introducing an import cycle between them.
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Rate limiter metrics.
+var (
+	RequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "firewall_requests_total",
+		Help: "Total requests seen by the rate limiter, by decision.",
+	}, []string{"decision"}) // decision: allow, brown, black
+
+	TrackedIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "firewall_tracked_ips",
+		Help: "Number of (ip, class) token buckets currently tracked.",
+	})
+
+	BrownlistedIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "firewall_brownlisted_ips",
+		Help: "Number of IPs currently serving a temporary brown-list ban.",
+	})
+
+	BlacklistedIPs = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "firewall_blacklisted_ips",
+		Help: "Number of IPs currently serving a permanent blacklist ban.",
+	})
+
+	IPRequestRate = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "firewall_ip_request_interval_seconds",
+		Help:    "Time between consecutive requests from the same IP.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"class"})
+)
+
+// Load balancer / backend metrics.
+var (
+	BackendRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadb_backend_requests_total",
+		Help: "Total requests proxied to a backend.",
+	}, []string{"address"})
+
+	BackendErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "loadb_backend_errors_total",
+		Help: "Total requests proxied to a backend that ended in an error.",
+	}, []string{"address"})
+
+	BackendLatencySeconds = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "loadb_backend_latency_seconds",
+		Help:    "Upstream response latency observed by the load balancer.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"address"})
+
+	BackendActiveConnections = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loadb_backend_active_connections",
+		Help: "Active connections currently being served by a backend.",
+	}, []string{"address"})
+
+	BackendAlive = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "loadb_backend_alive",
+		Help: "Whether a backend's last health check passed (1) or not (0).",
+	}, []string{"address"})
+)
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"net/http"
+	"net/http/pprof"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"Suboptimal/Firewall/events"
+)
+
+// newMetricsServer builds the internal operator HTTP server exposing
+// Prometheus metrics, pprof profiles, and the admin event stream. It is
+// served on its own port, separate from the public listener, so operator
+// telemetry can be kept off the internet entirely (e.g. bound to localhost
+// or firewalled at the network layer) rather than relying on an in-app
+// origin check to keep it private.
+func newMetricsServer(addr string, bus *events.Bus, logger *zap.Logger) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.HandleFunc("/admin/events", adminEventsHandler(bus, logger))
+	return &http.Server{Addr: addr, Handler: mux}
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/time/rate"
+
+	"Suboptimal/Firewall/events"
+	"Suboptimal/Firewall/metrics"
+)
+
+// idleLimiterTTL controls how long a per-(ip,class) limiter can sit unused
+// before cleanUp reclaims it.
+const idleLimiterTTL = 5 * time.Minute
+
+// Policy is the rate/burst pair applied to a single request class.
+type Policy struct {
+	Rate  float64 `json:"rate"`  // tokens replenished per second
+	Burst int     `json:"burst"` // maximum burst size
+}
+
+// PolicyConfig maps request classes to policies and decides which class a
+// given request belongs to, either via an explicit path prefix or by
+// falling back to a method/auth derived class.
+type PolicyConfig struct {
+	DefaultClass string            `json:"default_class"`
+	Classes      map[string]Policy `json:"classes"`
+	PathClasses  map[string]string `json:"path_classes"`
+}
+
+// loadPolicyConfig reads a PolicyConfig from path. A missing file is not an
+// error: callers fall back to defaultPolicyConfig so the firewall still
+// works out of the box.
+func loadPolicyConfig(path string, logger *zap.Logger) (PolicyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Info("rate limit policy file not found, using defaults", zap.String("path", path))
+			return defaultPolicyConfig(), nil
+		}
+		return PolicyConfig{}, err
+	}
+
+	var pc PolicyConfig
+	if err := json.Unmarshal(data, &pc); err != nil {
+		return PolicyConfig{}, fmt.Errorf("parsing rate limit policy file %q: %w", path, err)
+	}
+	return pc, nil
+}
+
+// defaultPolicyConfig mirrors the old fixed rateLimit/trackingDuration
+// behaviour, split across read/write and anonymous/authenticated classes.
+func defaultPolicyConfig() PolicyConfig {
+	base := float64(rateLimit) / trackingDuration.Seconds()
+	return PolicyConfig{
+		DefaultClass: "read-anon",
+		Classes: map[string]Policy{
+			"read-anon":  {Rate: base, Burst: rateLimit},
+			"write-anon": {Rate: base / 2, Burst: rateLimit / 2},
+			"read-auth":  {Rate: base * 2, Burst: rateLimit * 2},
+			"write-auth": {Rate: base, Burst: rateLimit},
+		},
+	}
+}
+
+// policyFor returns the policy for class, falling back to DefaultClass and
+// finally to a conservative built-in policy if neither is configured.
+func (pc PolicyConfig) policyFor(class string) Policy {
+	if p, ok := pc.Classes[class]; ok {
+		return p
+	}
+	if p, ok := pc.Classes[pc.DefaultClass]; ok {
+		return p
+	}
+	return Policy{Rate: 1, Burst: rateLimit}
+}
+
+// classify assigns a request to a policy class. Path prefixes configured in
+// PathClasses take precedence; otherwise the class is derived from the HTTP
+// method (read vs. write) and whether a Session-ID identifies the caller as
+// authenticated.
+func (pc PolicyConfig) classify(r *http.Request) string {
+	for prefix, class := range pc.PathClasses {
+		if strings.HasPrefix(r.URL.Path, prefix) {
+			return class
+		}
+	}
+
+	methodClass := "read"
+	switch r.Method {
+	case http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete:
+		methodClass = "write"
+	}
+
+	if r.Header.Get("Session-ID") != "" {
+		return methodClass + "-auth"
+	}
+	return methodClass + "-anon"
+}
+
+// limiterKey identifies a single token bucket.
+type limiterKey struct {
+	ip    string
+	class string
+}
+
+type limiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// violationEntry tracks how many times an IP has tripped a limit, alongside
+// lastSeen so cleanUp can evict it the same way it evicts idle limiters.
+type violationEntry struct {
+	count    int
+	lastSeen time.Time
+}
+
+type rateLimiter struct {
+	limiters        map[limiterKey]*limiterEntry
+	violationCounts map[string]*violationEntry
+	policies        PolicyConfig
+	store           BanStore
+	mu              sync.Mutex
+	blacklistCh     chan string
+	unblockCh       chan string
+	logger          *zap.Logger
+	ctx             context.Context
+	wg              sync.WaitGroup
+	events          *events.Bus
+}
+
+// newRateLimiter starts the background idle-limiter sweeper tied to ctx: it
+// exits as soon as ctx is cancelled, so callers can shut it down
+// deterministically alongside the rest of main. Ban state itself lives in
+// store rather than in-process, so restarts and other firewall nodes share
+// the same view of who is banned.
+func newRateLimiter(ctx context.Context, blacklistCh chan string, unblockCh chan string, policies PolicyConfig, store BanStore, bus *events.Bus, logger *zap.Logger) *rateLimiter {
+	rl := &rateLimiter{
+		limiters:        make(map[limiterKey]*limiterEntry),
+		violationCounts: make(map[string]*violationEntry),
+		policies:        policies,
+		store:           store,
+		blacklistCh:     blacklistCh,
+		unblockCh:       unblockCh,
+		logger:          logger,
+		ctx:             ctx,
+		events:          bus,
+	}
+	rl.wg.Add(1)
+	go func() {
+		defer rl.wg.Done()
+		rl.cleanUp()
+	}()
+	return rl
+}
+
+// Wait blocks until the cleanUp sweeper and any pending unblock timers have
+// exited after ctx is cancelled. Callers must not close blacklistCh or
+// unblockCh until Wait returns.
+func (rl *rateLimiter) Wait() {
+	rl.wg.Wait()
+}
+
+// sendBlacklistEvent pushes ip to blacklistCh, but gives up if ctx is
+// cancelled first so shutdown never blocks on a reader that already exited.
+func (rl *rateLimiter) sendBlacklistEvent(ip string) {
+	select {
+	case rl.blacklistCh <- ip:
+	case <-rl.ctx.Done():
+	}
+}
+
+// getLimiter returns the token bucket for (ip, class), allocating it lazily
+// on first use. Callers must hold rl.mu.
+func (rl *rateLimiter) getLimiter(ip, class string) *rate.Limiter {
+	key := limiterKey{ip: ip, class: class}
+	entry, ok := rl.limiters[key]
+	if !ok {
+		policy := rl.policies.policyFor(class)
+		entry = &limiterEntry{limiter: rate.NewLimiter(rate.Limit(policy.Rate), policy.Burst)}
+		rl.limiters[key] = entry
+		rl.events.Publish(events.Event{Type: events.TypeIPSeen, IP: ip})
+		metrics.TrackedIPs.Set(float64(len(rl.limiters)))
+	} else {
+		metrics.IPRequestRate.WithLabelValues(class).Observe(time.Since(entry.lastSeen).Seconds())
+	}
+	entry.lastSeen = time.Now()
+	return entry.limiter
+}
+
+// recordViolation bumps ip's violation count and refreshes its lastSeen so
+// cleanUp can evict it once it's been idle for idleLimiterTTL, the same way
+// it evicts idle limiters.
+func (rl *rateLimiter) recordViolation(ip string) int {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	v, ok := rl.violationCounts[ip]
+	if !ok {
+		v = &violationEntry{}
+		rl.violationCounts[ip] = v
+	}
+	v.count++
+	v.lastSeen = time.Now()
+	return v.count
+}
+
+// allow consults the (ip, class) token bucket and reports whether the
+// request is allowed, and if not, how long the caller should wait before
+// retrying.
+func (rl *rateLimiter) allow(ip, class string) (bool, time.Duration) {
+	rl.mu.Lock()
+	lim := rl.getLimiter(ip, class)
+	rl.mu.Unlock()
+
+	res := lim.Reserve()
+	if !res.OK() {
+		return false, 0
+	}
+	if delay := res.Delay(); delay > 0 {
+		res.Cancel()
+		return false, delay
+	}
+	return true, 0
+}
+
+func (rl *rateLimiter) sessionCheck(ip, class string, logger *zap.Logger) (bool, time.Duration) {
+	if banned, err := rl.store.IsBanned(ip); err != nil {
+		logger.Error("ban store lookup failed", zap.String("ip", ip), zap.Error(err))
+	} else if banned {
+		metrics.RequestsTotal.WithLabelValues("brown").Inc()
+		return false, brownListedDuration
+	}
+
+	allowed, retryAfter := rl.allow(ip, class)
+	if !allowed {
+		hits := rl.recordViolation(ip)
+
+		expiresAt := time.Now().Add(brownListedDuration)
+		if err := rl.store.Ban(ip, brownListedDuration); err != nil {
+			logger.Error("failed to persist brown-list ban", zap.String("ip", ip), zap.Error(err))
+		}
+
+		logger.Warn("ip brown-listed",
+			zap.String("ip", ip),
+			zap.String("reason", "session_rate_exceeded"),
+			zap.Int("hits", hits),
+			zap.Duration("window", brownListedDuration),
+			zap.Time("expires_at", expiresAt),
+		)
+		rl.sendBlacklistEvent(ip)
+		rl.events.Publish(events.Event{Type: events.TypeBrownlisted, IP: ip})
+		metrics.RequestsTotal.WithLabelValues("brown").Inc()
+		metrics.BrownlistedIPs.Inc()
+		rl.wg.Add(1)
+		go func() {
+			defer rl.wg.Done()
+			startTimer(rl.ctx, ip, rl.unblockCh, brownListedDuration, logger, rl.events)
+		}()
+		return false, brownListedDuration
+	}
+
+	metrics.RequestsTotal.WithLabelValues("allow").Inc()
+	return true, retryAfter
+}
+
+// startTimer waits out duration, then reports ip as unblocked. It exits
+// early, without sending, if ctx is cancelled first.
+func startTimer(ctx context.Context, ip string, unblockCh chan string, duration time.Duration, logger *zap.Logger, bus *events.Bus) {
+	select {
+	case <-time.After(duration):
+	case <-ctx.Done():
+		return
+	}
+	logger.Info("ip unblocked", zap.String("ip", ip))
+	bus.Publish(events.Event{Type: events.TypeUnblocked, IP: ip})
+	metrics.BrownlistedIPs.Dec()
+	select {
+	case unblockCh <- ip:
+	case <-ctx.Done():
+	}
+}
+
+func (rl *rateLimiter) limitCheck(ip, class string, logger *zap.Logger) (bool, time.Duration) {
+	if banned, err := rl.store.IsBanned(ip); err != nil {
+		logger.Error("ban store lookup failed", zap.String("ip", ip), zap.Error(err))
+	} else if banned {
+		metrics.RequestsTotal.WithLabelValues("black").Inc()
+		return false, 0
+	}
+
+	allowed, retryAfter := rl.allow(ip, class)
+	if !allowed {
+		hits := rl.recordViolation(ip)
+
+		if err := rl.store.Ban(ip, 0); err != nil { // permanent, until explicitly unbanned
+			logger.Error("failed to persist blacklist ban", zap.String("ip", ip), zap.Error(err))
+		}
+
+		logger.Warn("ip blacklisted",
+			zap.String("ip", ip),
+			zap.String("reason", "rate_exceeded"),
+			zap.Int("hits", hits),
+			zap.Duration("window", trackingDuration),
+		)
+		rl.sendBlacklistEvent(ip)
+		rl.events.Publish(events.Event{Type: events.TypeBlacklisted, IP: ip})
+		metrics.RequestsTotal.WithLabelValues("black").Inc()
+		metrics.BlacklistedIPs.Inc()
+	} else {
+		metrics.RequestsTotal.WithLabelValues("allow").Inc()
+	}
+	return allowed, retryAfter
+}
+
+// cleanUp periodically evicts token buckets and violation counts that have
+// been idle for longer than idleLimiterTTL, so long-running firewalls don't
+// accumulate one entry per distinct IP ever seen for the life of the
+// process. It exits once rl.ctx is cancelled.
+func (rl *rateLimiter) cleanUp() {
+	ticker := time.NewTicker(idleLimiterTTL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-rl.ctx.Done():
+			return
+		case <-ticker.C:
+			rl.mu.Lock()
+			cutoff := time.Now().Add(-idleLimiterTTL)
+			for key, entry := range rl.limiters {
+				if entry.lastSeen.Before(cutoff) {
+					delete(rl.limiters, key)
+				}
+			}
+			for ip, v := range rl.violationCounts {
+				if v.lastSeen.Before(cutoff) {
+					delete(rl.violationCounts, ip)
+				}
+			}
+			metrics.TrackedIPs.Set(float64(len(rl.limiters)))
+			rl.mu.Unlock()
+		}
+	}
+}
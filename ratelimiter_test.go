@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+
+	"Suboptimal/Firewall/events"
+)
+
+// fakeBanStore is an in-memory BanStore stand-in for tests that don't need
+// persistence or cross-node fan-out, just to observe what got banned.
+type fakeBanStore struct {
+	banned map[string]time.Duration
+}
+
+func newFakeBanStore() *fakeBanStore {
+	return &fakeBanStore{banned: make(map[string]time.Duration)}
+}
+
+func (s *fakeBanStore) Ban(ip string, ttl time.Duration) error {
+	s.banned[ip] = ttl
+	return nil
+}
+
+func (s *fakeBanStore) Unban(ip string) error {
+	delete(s.banned, ip)
+	return nil
+}
+
+func (s *fakeBanStore) IsBanned(ip string) (bool, error) {
+	_, ok := s.banned[ip]
+	return ok, nil
+}
+
+func (s *fakeBanStore) Bans() (map[string]time.Time, error) {
+	out := make(map[string]time.Time)
+	for ip := range s.banned {
+		out[ip] = time.Time{}
+	}
+	return out, nil
+}
+
+func (s *fakeBanStore) Subscribe() <-chan BanEvent {
+	return make(chan BanEvent)
+}
+
+func (s *fakeBanStore) Close() error { return nil }
+
+func TestPolicyConfigClassify(t *testing.T) {
+	pc := PolicyConfig{
+		PathClasses: map[string]string{"/admin": "admin"},
+	}
+
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		sessionID string
+		want      string
+	}{
+		{name: "configured path prefix wins", method: http.MethodGet, path: "/admin/users", want: "admin"},
+		{name: "anonymous read", method: http.MethodGet, path: "/items", want: "read-anon"},
+		{name: "anonymous write", method: http.MethodPost, path: "/items", want: "write-anon"},
+		{name: "authenticated read", method: http.MethodGet, path: "/items", sessionID: "s1", want: "read-auth"},
+		{name: "authenticated write", method: http.MethodDelete, path: "/items/1", sessionID: "s1", want: "write-auth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			if tt.sessionID != "" {
+				r.Header.Set("Session-ID", tt.sessionID)
+			}
+			if got := pc.classify(r); got != tt.want {
+				t.Errorf("classify() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPolicyConfigPolicyFor(t *testing.T) {
+	pc := PolicyConfig{
+		DefaultClass: "read-anon",
+		Classes: map[string]Policy{
+			"read-anon": {Rate: 1, Burst: 5},
+		},
+	}
+
+	if got := pc.policyFor("read-anon"); got != (Policy{Rate: 1, Burst: 5}) {
+		t.Errorf("policyFor(configured class) = %+v, want {Rate:1 Burst:5}", got)
+	}
+
+	// Unknown class falls back to DefaultClass's policy.
+	if got := pc.policyFor("write-auth"); got != (Policy{Rate: 1, Burst: 5}) {
+		t.Errorf("policyFor(unconfigured class) = %+v, want fallback to default class's policy", got)
+	}
+
+	// Neither the class nor DefaultClass configured: built-in fallback.
+	empty := PolicyConfig{}
+	if got := empty.policyFor("anything"); got != (Policy{Rate: 1, Burst: rateLimit}) {
+		t.Errorf("policyFor with no config = %+v, want {Rate:1 Burst:%d}", got, rateLimit)
+	}
+}
+
+// TestRateLimiterBurstExhaustionBlacklists drives a single-burst policy past
+// its limit and checks the full chain: the request is denied, the IP is
+// persisted to the ban store as a permanent ban, and a blacklist event is
+// sent on blacklistCh for PkfilterInit to apply.
+func TestRateLimiterBurstExhaustionBlacklists(t *testing.T) {
+	policies := PolicyConfig{
+		DefaultClass: "read-anon",
+		Classes: map[string]Policy{
+			"read-anon": {Rate: 0, Burst: 1},
+		},
+	}
+	store := newFakeBanStore()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	blacklistCh := make(chan string, 1)
+	unblockCh := make(chan string, 1)
+	rl := newRateLimiter(ctx, blacklistCh, unblockCh, policies, store, events.NewBus(), zap.NewNop())
+
+	const ip = "9.9.9.9"
+	allowed, _ := rl.limitCheck(ip, "read-anon", zap.NewNop())
+	if !allowed {
+		t.Fatalf("first request should consume the single burst token and be allowed")
+	}
+
+	allowed, _ = rl.limitCheck(ip, "read-anon", zap.NewNop())
+	if allowed {
+		t.Fatalf("second request should be denied once the burst is exhausted")
+	}
+
+	if _, ok := store.banned[ip]; !ok {
+		t.Fatalf("expected %q to be persisted to the ban store", ip)
+	}
+	if ttl := store.banned[ip]; ttl != 0 {
+		t.Fatalf("blacklist ban ttl = %v, want 0 (permanent)", ttl)
+	}
+
+	select {
+	case gotIP := <-blacklistCh:
+		if gotIP != ip {
+			t.Fatalf("blacklistCh got %q, want %q", gotIP, ip)
+		}
+	default:
+		t.Fatalf("expected %q to be sent on blacklistCh", ip)
+	}
+}